@@ -17,21 +17,87 @@
 package authn
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
 	"time"
 
+	"code.gitea.io/sdk/gitea"
 	"github.com/cesanta/docker_auth/auth_server/api"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// Supported values for GiteaAuthConfig.Mode.
+const (
+	GiteaAuthModeBasic  = "basic"
+	GiteaAuthModeOAuth2 = "oauth2"
+)
+
+const (
+	giteaOAuthAuthorizePath   = "/login/oauth/authorize"
+	giteaOAuthAccessTokenPath = "/v1/login/oauth/access_token"
+
+	// Paths the auth server registers GiteaLoginHandler/GiteaCallbackHandler on.
+	GiteaOAuthLoginPath    = "/gitea/login"
+	GiteaOAuthCallbackPath = "/gitea/callback"
+
+	giteaListPageSize = 50
+)
+
 type GiteaAuthConfig struct {
+	Mode            string        `yaml:"mode,omitempty"`
 	ApiUri          string        `yaml:"api_uri,omitempty"`
 	TokenDB         string        `yaml:"token_db,omitempty"`
 	HTTPTimeout     time.Duration `yaml:"http_timeout,omitempty"`
 	RevalidateAfter time.Duration `yaml:"revalidate_after,omitempty"`
+
+	// MinGiteaVersion fails startup unless the server satisfies it (e.g. "1.20.0").
+	MinGiteaVersion string `yaml:"min_gitea_version,omitempty"`
+
+	// OAuth2/OIDC settings, only used when Mode is "oauth2".
+	ClientID     string   `yaml:"client_id,omitempty"`
+	ClientSecret string   `yaml:"client_secret,omitempty"`
+	RedirectURI  string   `yaml:"redirect_uri,omitempty"`
+	Scopes       []string `yaml:"scopes,omitempty"`
+
+	// Orgs restricts access to members of at least one listed org/team.
+	// Empty preserves the legacy behaviour of labelling every org the user belongs to.
+	Orgs []OrgFilter `yaml:"orgs,omitempty"`
+	// LoadAllGroups bypasses the Orgs allow-list check but still labels every org/team.
+	LoadAllGroups bool `yaml:"load_all_groups,omitempty"`
+
+	// RequiredScopes rejects credentials missing any of the listed PAT scopes.
+	RequiredScopes []string `yaml:"required_scopes,omitempty"`
+
+	TLS   *GiteaTLSConfig   `yaml:"tls,omitempty"`
+	Proxy string            `yaml:"proxy,omitempty"`
+	Retry *GiteaRetryConfig `yaml:"retry,omitempty"`
+}
+
+type OrgFilter struct {
+	Name  string   `yaml:"name,omitempty"`
+	Teams []string `yaml:"teams,omitempty"`
+}
+
+type GiteaTLSConfig struct {
+	CACert             string `yaml:"ca_cert,omitempty"`
+	ClientCert         string `yaml:"client_cert,omitempty"`
+	ClientKey          string `yaml:"client_key,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+}
+
+type GiteaRetryConfig struct {
+	MaxAttempts int           `yaml:"max_attempts,omitempty"`
+	Backoff     time.Duration `yaml:"backoff,omitempty"`
 }
 
 type GiteaAuth struct {
@@ -40,16 +106,11 @@ type GiteaAuth struct {
 	db     TokenDB
 }
 
-type GiteaOrganization struct {
-	Id       int64  `json:"id"`
-	Name     string `json:"name"`
-	FullName string `json:"full_name"`
-	/** @deprecated */
-	Username    string `json:"username"`
-	AvatarUrl   string `json:"avatar_url"`
-	Description string `json:"description"`
-	Location    string `json:"location"`
-	Website     string `json:"website"`
+type giteaOAuthToken struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
 }
 
 func NewGiteaAuth(c *GiteaAuthConfig) (*GiteaAuth, error) {
@@ -58,11 +119,157 @@ func NewGiteaAuth(c *GiteaAuthConfig) (*GiteaAuth, error) {
 		return nil, err
 	}
 
-	return &GiteaAuth{
+	if c.mode() == GiteaAuthModeOAuth2 && (c.ClientID == "" || c.ClientSecret == "" || c.RedirectURI == "") {
+		return nil, fmt.Errorf("gitea auth: client_id, client_secret and redirect_uri are required when mode is %q", GiteaAuthModeOAuth2)
+	}
+
+	client, err := newHTTPClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	gta := &GiteaAuth{
 		config: c,
-		client: &http.Client{Timeout: 10 * time.Second},
+		client: client,
 		db:     db,
-	}, nil
+	}
+
+	if c.MinGiteaVersion != "" {
+		if err := gta.checkMinVersion(); err != nil {
+			return nil, err
+		}
+	}
+
+	return gta, nil
+}
+
+func newHTTPClient(c *GiteaAuthConfig) (*http.Client, error) {
+	timeout := c.HTTPTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if c.Proxy != "" {
+		proxyUri, err := url.Parse(c.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse proxy url: %s", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyUri)
+	}
+
+	if c.TLS != nil {
+		tlsConfig, err := buildTLSConfig(c.TLS)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	var rt http.RoundTripper = transport
+	if c.Retry != nil && c.Retry.MaxAttempts > 1 {
+		rt = &retryingRoundTripper{
+			next:        transport,
+			maxAttempts: c.Retry.MaxAttempts,
+			backoff:     c.Retry.Backoff,
+		}
+	}
+
+	return &http.Client{Timeout: timeout, Transport: rt}, nil
+}
+
+func buildTLSConfig(c *GiteaTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+
+	if c.CACert != "" {
+		caCert, err := os.ReadFile(c.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("could not read ca_cert: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("could not parse ca_cert %q", c.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.ClientCert != "" || c.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client_cert/client_key: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// retryingRoundTripper retries on error or 5xx, with exponential backoff.
+type retryingRoundTripper struct {
+	next        http.RoundTripper
+	maxAttempts int
+	backoff     time.Duration
+}
+
+func (rt *retryingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+
+	backoff := rt.backoff
+	if backoff <= 0 {
+		backoff = 500 * time.Millisecond
+	}
+
+	var resp *http.Response
+	var err error
+
+	for attempt := 0; attempt < rt.maxAttempts; attempt++ {
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		resp, err = rt.next.RoundTrip(req)
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			return resp, nil
+		}
+
+		if attempt == rt.maxAttempts-1 {
+			break
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		time.Sleep(backoff << uint(attempt))
+	}
+
+	return resp, err
+}
+
+func (gta *GiteaAuth) checkMinVersion() error {
+	client, err := gitea.NewClient(gta.getBaseUri(), gitea.SetHTTPClient(gta.client))
+	if err != nil {
+		return fmt.Errorf("could not create gitea client: %s", err)
+	}
+
+	if err := client.CheckServerVersionConstraint(">=" + gta.config.MinGiteaVersion); err != nil {
+		return fmt.Errorf("gitea server does not satisfy min_gitea_version %q: %s", gta.config.MinGiteaVersion, err)
+	}
+
+	return nil
+}
+
+func (c *GiteaAuthConfig) mode() string {
+	if c.Mode == "" {
+		return GiteaAuthModeBasic
+	}
+	return c.Mode
 }
 
 func (gta *GiteaAuth) getApiUri() string {
@@ -73,39 +280,390 @@ func (gta *GiteaAuth) getApiUri() string {
 	}
 }
 
-func (gta *GiteaAuth) fetchUserOrgs(user string, password string) ([]*GiteaOrganization, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/v1/user/orgs", gta.getApiUri()), nil)
+// getBaseUri strips the trailing "/api" that the browser-facing OAuth2
+// endpoints and code.gitea.io/sdk/gitea don't expect.
+func (gta *GiteaAuth) getBaseUri() string {
+	return strings.TrimSuffix(gta.getApiUri(), "/api")
+}
+
+func (gta *GiteaAuth) clientForBasicAuth(user string, password string) (*gitea.Client, error) {
+	return gitea.NewClient(gta.getBaseUri(), gitea.SetBasicAuth(user, password), gitea.SetHTTPClient(gta.client))
+}
+
+func (gta *GiteaAuth) clientForToken(accessToken string) (*gitea.Client, error) {
+	return gitea.NewClient(gta.getBaseUri(), gitea.SetToken(accessToken), gitea.SetHTTPClient(gta.client))
+}
+
+func translateErr(resp *gitea.Response, err error) error {
+	if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+		return api.WrongPass
+	}
+	return fmt.Errorf("gitea api error: %s", err)
+}
+
+func (gta *GiteaAuth) fetchUserOrgs(client *gitea.Client) ([]*gitea.Organization, error) {
+	var all []*gitea.Organization
+
+	opt := gitea.ListOrgsOptions{ListOptions: gitea.ListOptions{Page: 1, PageSize: giteaListPageSize}}
+	for {
+		orgs, resp, err := client.ListMyOrgs(opt)
+		if err != nil {
+			return nil, translateErr(resp, err)
+		}
+
+		all = append(all, orgs...)
+		if len(orgs) < opt.PageSize {
+			break
+		}
+		opt.Page++
+	}
+
+	return all, nil
+}
+
+func (gta *GiteaAuth) fetchUserTeams(client *gitea.Client) ([]*gitea.Team, error) {
+	var all []*gitea.Team
+
+	opt := &gitea.ListTeamsOptions{ListOptions: gitea.ListOptions{Page: 1, PageSize: giteaListPageSize}}
+	for {
+		teams, resp, err := client.ListMyTeams(opt)
+		if err != nil {
+			return nil, translateErr(resp, err)
+		}
+
+		all = append(all, teams...)
+		if len(teams) < opt.PageSize {
+			break
+		}
+		opt.Page++
+	}
+
+	return all, nil
+}
+
+func (gta *GiteaAuth) fetchUser(client *gitea.Client) (*gitea.User, error) {
+	u, resp, err := client.GetMyUserInfo()
 	if err != nil {
-		return nil, fmt.Errorf("could not create request to gitea api: %s", err)
+		return nil, translateErr(resp, err)
 	}
+	return u, nil
+}
 
-	req.SetBasicAuth(user, password)
-	resp, err := gta.client.Do(req)
+// checkRequiredScopes is a no-op when RequiredScopes is empty.
+func (gta *GiteaAuth) checkRequiredScopes(client *gitea.Client) ([]string, error) {
+	if len(gta.config.RequiredScopes) == 0 {
+		return nil, nil
+	}
 
+	scopes, err := gta.fetchTokenScopes(client)
 	if err != nil {
 		return nil, err
 	}
 
-	if resp.StatusCode == http.StatusUnauthorized {
-		return nil, api.WrongPass
-	} else if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("could not get user orgs, statusCode: %d", resp.StatusCode)
+	if missing := missingScopes(gta.config.RequiredScopes, scopes); len(missing) > 0 {
+		return nil, fmt.Errorf("gitea credential is missing required scope(s): %s", strings.Join(missing, ", "))
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	return scopes, nil
+}
+
+// fetchTokenScopes reads X-Gitea-Token-Scopes; there's no safe fallback
+// since listing the user's tokens would check scopes of PATs other than
+// the one actually presented.
+func (gta *GiteaAuth) fetchTokenScopes(client *gitea.Client) ([]string, error) {
+	_, resp, err := client.GetMyUserInfo()
+	if err != nil {
+		return nil, translateErr(resp, err)
+	}
+
+	if resp != nil {
+		if h := resp.Header.Get("X-Gitea-Token-Scopes"); h != "" {
+			var scopes []string
+			for _, s := range strings.Split(h, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					scopes = append(scopes, s)
+				}
+			}
+			return scopes, nil
+		}
+	}
+
+	return nil, fmt.Errorf("gitea server did not report token scopes (X-Gitea-Token-Scopes missing); cannot verify required_scopes")
+}
+
+func missingScopes(required []string, have []string) []string {
+	haveSet := map[string]bool{}
+	for _, s := range have {
+		haveSet[s] = true
+	}
+
+	var missing []string
+	for _, r := range required {
+		if !haveSet[r] {
+			missing = append(missing, r)
+		}
+	}
+	return missing
+}
+
+func (gta *GiteaAuth) needsTeams() bool {
+	if gta.config.LoadAllGroups {
+		return true
+	}
+	for _, filter := range gta.config.Orgs {
+		if len(filter.Teams) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// buildGroups applies the Orgs allow-list, returning api.NoMatch if nothing matched.
+func (gta *GiteaAuth) buildGroups(orgs []*gitea.Organization, teams []*gitea.Team) ([]string, error) {
+	teamsByOrg := map[string]map[string]bool{}
+	for _, t := range teams {
+		if t.Organization == nil {
+			continue
+		}
+		if teamsByOrg[t.Organization.UserName] == nil {
+			teamsByOrg[t.Organization.UserName] = map[string]bool{}
+		}
+		teamsByOrg[t.Organization.UserName][t.Name] = true
+	}
+
+	allGroups := func() []string {
+		var groups []string
+		for _, org := range orgs {
+			groups = append(groups, org.UserName)
+			for team := range teamsByOrg[org.UserName] {
+				groups = append(groups, fmt.Sprintf("%s:%s", org.UserName, team))
+			}
+		}
+		return groups
+	}
+
+	if len(gta.config.Orgs) == 0 || gta.config.LoadAllGroups {
+		return allGroups(), nil
+	}
+
+	orgByName := map[string]*gitea.Organization{}
+	for _, org := range orgs {
+		orgByName[org.UserName] = org
+	}
+
+	var groups []string
+	matched := false
+
+	for _, filter := range gta.config.Orgs {
+		org, ok := orgByName[filter.Name]
+		if !ok {
+			continue
+		}
+
+		if len(filter.Teams) == 0 {
+			matched = true
+			groups = append(groups, org.UserName)
+			for team := range teamsByOrg[org.UserName] {
+				groups = append(groups, fmt.Sprintf("%s:%s", org.UserName, team))
+			}
+			continue
+		}
+
+		for _, team := range filter.Teams {
+			if teamsByOrg[org.UserName][team] {
+				matched = true
+				groups = append(groups, org.UserName, fmt.Sprintf("%s:%s", org.UserName, team))
+			}
+		}
+	}
+
+	if !matched {
+		return nil, api.NoMatch
+	}
+
+	return groups, nil
+}
+
+func (gta *GiteaAuth) exchangeCode(code string) (*giteaOAuthToken, error) {
+	form := url.Values{
+		"client_id":     {gta.config.ClientID},
+		"client_secret": {gta.config.ClientSecret},
+		"grant_type":    {"authorization_code"},
+		"redirect_uri":  {gta.config.RedirectURI},
+		"code":          {code},
+	}
+
+	return gta.requestOAuthToken(form)
+}
+
+func (gta *GiteaAuth) refreshToken(refreshToken string) (*giteaOAuthToken, error) {
+	form := url.Values{
+		"client_id":     {gta.config.ClientID},
+		"client_secret": {gta.config.ClientSecret},
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	}
+
+	return gta.requestOAuthToken(form)
+}
+
+func (gta *GiteaAuth) requestOAuthToken(form url.Values) (*giteaOAuthToken, error) {
+	tokenUri := fmt.Sprintf("%s%s", gta.getApiUri(), giteaOAuthAccessTokenPath)
+
+	req, err := http.NewRequest("POST", tokenUri, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("could not create oauth2 token request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := gta.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
 
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("could not read response body: %s", err)
+		return nil, fmt.Errorf("could not read oauth2 token response: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not exchange oauth2 token, statusCode: %d, body: %s", resp.StatusCode, body)
+	}
+
+	var tok giteaOAuthToken
+	if err := json.Unmarshal(body, &tok); err != nil {
+		return nil, fmt.Errorf("could not parse oauth2 token response: %s", err)
 	}
 
-	var orgs []*GiteaOrganization
-	err = json.Unmarshal(body, &orgs)
+	return &tok, nil
+}
+
+func (gta *GiteaAuth) GiteaLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if gta.config.mode() != GiteaAuthModeOAuth2 {
+		http.Error(w, "gitea oauth2 login is not enabled", http.StatusNotFound)
+		return
+	}
+
+	state, err := randomState()
 	if err != nil {
-		return nil, fmt.Errorf("could not parse gitea response: %s", err)
+		http.Error(w, "could not generate state", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "gitea_oauth_state",
+		Value:    state,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int((5 * time.Minute).Seconds()),
+	})
+
+	q := url.Values{
+		"client_id":     {gta.config.ClientID},
+		"redirect_uri":  {gta.config.RedirectURI},
+		"response_type": {"code"},
+		"state":         {state},
+	}
+	if len(gta.config.Scopes) > 0 {
+		q.Set("scope", strings.Join(gta.config.Scopes, " "))
 	}
 
-	return orgs, nil
+	authorizeUri := fmt.Sprintf("%s%s?%s", gta.getBaseUri(), giteaOAuthAuthorizePath, q.Encode())
+	http.Redirect(w, r, authorizeUri, http.StatusFound)
+}
+
+func (gta *GiteaAuth) GiteaCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if gta.config.mode() != GiteaAuthModeOAuth2 {
+		http.Error(w, "gitea oauth2 login is not enabled", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	state := q.Get("state")
+	if c, err := r.Cookie("gitea_oauth_state"); err != nil || c.Value == "" || c.Value != state {
+		http.Error(w, "invalid oauth2 state", http.StatusBadRequest)
+		return
+	}
+
+	code := q.Get("code")
+	if code == "" {
+		http.Error(w, "missing oauth2 code", http.StatusBadRequest)
+		return
+	}
+
+	tok, err := gta.exchangeCode(code)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not exchange oauth2 code: %s", err), http.StatusBadGateway)
+		return
+	}
+
+	client, err := gta.clientForToken(tok.AccessToken)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not create gitea client: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	scopes, err := gta.checkRequiredScopes(client)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("access denied: %s", err), http.StatusForbidden)
+		return
+	}
+
+	user, err := gta.fetchUser(client)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not fetch gitea user: %s", err), http.StatusBadGateway)
+		return
+	}
+
+	orgs, err := gta.fetchUserOrgs(client)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not fetch gitea orgs: %s", err), http.StatusBadGateway)
+		return
+	}
+
+	var teams []*gitea.Team
+	if gta.needsTeams() {
+		teams, err = gta.fetchUserTeams(client)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not fetch gitea teams: %s", err), http.StatusBadGateway)
+			return
+		}
+	}
+
+	groups, err := gta.buildGroups(orgs, teams)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("access denied: %s", err), http.StatusForbidden)
+		return
+	}
+	labels := api.Labels{"group": groups}
+
+	if err := gta.storeOAuthToken(user.UserName, tok, labels, scopes); err != nil {
+		http.Error(w, fmt.Sprintf("could not store gitea token: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "Login successful. Use %q as your username and the following token as your password for `docker login`:\n\n%s\n", user.UserName, tok.AccessToken)
+}
+
+func (gta *GiteaAuth) RegisterRoutes(mux *http.ServeMux) {
+	if gta.config.mode() != GiteaAuthModeOAuth2 {
+		return
+	}
+	mux.HandleFunc(GiteaOAuthLoginPath, gta.GiteaLoginHandler)
+	mux.HandleFunc(GiteaOAuthCallbackPath, gta.GiteaCallbackHandler)
+}
+
+func randomState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
 
 func (gta *GiteaAuth) getValidToken(user string, password api.PasswordString) (*TokenDBValue, error) {
@@ -128,10 +686,14 @@ func (gta *GiteaAuth) getValidToken(user string, password api.PasswordString) (*
 		return nil, ExpiredToken
 	}
 
+	if missing := missingScopes(gta.config.RequiredScopes, dbv.Scopes); len(missing) > 0 {
+		return nil, fmt.Errorf("gitea credential is missing required scope(s): %s", strings.Join(missing, ", "))
+	}
+
 	return dbv, nil
 }
 
-func (gta *GiteaAuth) storeToken(user string, password api.PasswordString, labels api.Labels) error {
+func (gta *GiteaAuth) storeToken(user string, password api.PasswordString, labels api.Labels, scopes []string) error {
 	userPasswd := gta.getUserToken(user, password)
 
 	dph, err := bcrypt.GenerateFromPassword([]byte(userPasswd), bcrypt.DefaultCost)
@@ -144,6 +706,7 @@ func (gta *GiteaAuth) storeToken(user string, password api.PasswordString, label
 		AccessToken: string(dph),
 		ValidUntil:  time.Now().Add(gta.config.RevalidateAfter),
 		Labels:      labels,
+		Scopes:      scopes,
 	}
 
 	// do not update password, it's not used
@@ -154,31 +717,151 @@ func (gta *GiteaAuth) storeToken(user string, password api.PasswordString, label
 	return nil
 }
 
+func (gta *GiteaAuth) storeOAuthToken(login string, tok *giteaOAuthToken, labels api.Labels, scopes []string) error {
+	dph, err := bcrypt.GenerateFromPassword([]byte(tok.AccessToken), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("could not hash token: %s", err)
+	}
+
+	v := &TokenDBValue{
+		TokenType:    "Bearer",
+		AccessToken:  string(dph),
+		RefreshToken: tok.RefreshToken,
+		ValidUntil:   time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second),
+		Labels:       labels,
+		Scopes:       scopes,
+	}
+
+	if _, err := gta.db.StoreToken(login, v, false); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (gta *GiteaAuth) getUserToken(user string, password api.PasswordString) string {
 	return fmt.Sprintf("%s:%s", user, string(password))
 }
 
 func (gta *GiteaAuth) Authenticate(user string, password api.PasswordString) (bool, api.Labels, error) {
+	if gta.config.mode() == GiteaAuthModeOAuth2 {
+		return gta.authenticateOAuth2(user, password)
+	}
+	return gta.authenticateBasic(user, password)
+}
+
+func (gta *GiteaAuth) authenticateBasic(user string, password api.PasswordString) (bool, api.Labels, error) {
 	if dbv, err := gta.getValidToken(user, password); err == nil {
 		return true, dbv.Labels, nil
 	}
 
-	orgs, err := gta.fetchUserOrgs(user, string(password))
+	client, err := gta.clientForBasicAuth(user, string(password))
+	if err != nil {
+		return false, nil, fmt.Errorf("could not create gitea client: %s", err)
+	}
+
+	scopes, err := gta.checkRequiredScopes(client)
 	if err != nil {
 		return false, nil, err
 	}
 
-	var groups []string
+	orgs, err := gta.fetchUserOrgs(client)
+	if err != nil {
+		return false, nil, err
+	}
 
-	for _, org := range orgs {
-		groups = append(groups, org.Name)
+	var teams []*gitea.Team
+	if gta.needsTeams() {
+		teams, err = gta.fetchUserTeams(client)
+		if err != nil {
+			return false, nil, err
+		}
+	}
+
+	groups, err := gta.buildGroups(orgs, teams)
+	if err != nil {
+		return false, nil, err
 	}
 
 	labels := api.Labels{
 		"group": groups,
 	}
 
-	if err := gta.storeToken(user, password, labels); err != nil {
+	if err := gta.storeToken(user, password, labels, scopes); err != nil {
+		return false, nil, err
+	}
+
+	return true, labels, nil
+}
+
+// authenticateOAuth2 rotates the Gitea access/refresh token transparently once it expires.
+func (gta *GiteaAuth) authenticateOAuth2(user string, password api.PasswordString) (bool, api.Labels, error) {
+	dbv, err := gta.db.GetValue(user)
+	if err != nil {
+		return false, nil, err
+	}
+	if dbv == nil {
+		return false, nil, api.NoMatch
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(dbv.AccessToken), []byte(password)); err != nil {
+		return false, nil, api.WrongPass
+	}
+
+	if time.Now().Before(dbv.ValidUntil) {
+		if missing := missingScopes(gta.config.RequiredScopes, dbv.Scopes); len(missing) > 0 {
+			return false, nil, fmt.Errorf("gitea credential is missing required scope(s): %s", strings.Join(missing, ", "))
+		}
+		return true, dbv.Labels, nil
+	}
+
+	if dbv.RefreshToken == "" {
+		return false, nil, ExpiredToken
+	}
+
+	tok, err := gta.refreshToken(dbv.RefreshToken)
+	if err != nil {
+		return false, nil, fmt.Errorf("could not refresh gitea token: %s", err)
+	}
+
+	client, err := gta.clientForToken(tok.AccessToken)
+	if err != nil {
+		return false, nil, fmt.Errorf("could not create gitea client: %s", err)
+	}
+
+	scopes, err := gta.checkRequiredScopes(client)
+	if err != nil {
+		return false, nil, err
+	}
+
+	orgs, err := gta.fetchUserOrgs(client)
+	if err != nil {
+		return false, nil, err
+	}
+
+	var teams []*gitea.Team
+	if gta.needsTeams() {
+		teams, err = gta.fetchUserTeams(client)
+		if err != nil {
+			return false, nil, err
+		}
+	}
+
+	groups, err := gta.buildGroups(orgs, teams)
+	if err != nil {
+		return false, nil, err
+	}
+	labels := api.Labels{"group": groups}
+
+	v := &TokenDBValue{
+		TokenType:    "Bearer",
+		AccessToken:  dbv.AccessToken,
+		RefreshToken: tok.RefreshToken,
+		ValidUntil:   time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second),
+		Labels:       labels,
+		Scopes:       scopes,
+	}
+	if _, err := gta.db.StoreToken(user, v, false); err != nil {
 		return false, nil, err
 	}
 
@@ -0,0 +1,371 @@
+package authn
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"code.gitea.io/sdk/gitea"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func org(name string) *gitea.Organization {
+	return &gitea.Organization{UserName: name}
+}
+
+func team(name string, org *gitea.Organization) *gitea.Team {
+	return &gitea.Team{Name: name, Organization: org}
+}
+
+func TestBuildGroups(t *testing.T) {
+	acme := org("acme")
+	widgets := org("widgets")
+
+	acmeDevs := team("devs", acme)
+	acmeOps := team("ops", acme)
+
+	tests := []struct {
+		name    string
+		cfg     GiteaAuthConfig
+		orgs    []*gitea.Organization
+		teams   []*gitea.Team
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "no filter returns all orgs and teams",
+			cfg:   GiteaAuthConfig{},
+			orgs:  []*gitea.Organization{acme, widgets},
+			teams: []*gitea.Team{acmeDevs, acmeOps},
+			want:  []string{"acme", "acme:devs", "acme:ops", "widgets"},
+		},
+		{
+			name: "org-level filter matches whole org",
+			cfg: GiteaAuthConfig{
+				Orgs: []OrgFilter{{Name: "acme"}},
+			},
+			orgs:  []*gitea.Organization{acme, widgets},
+			teams: []*gitea.Team{acmeDevs},
+			want:  []string{"acme", "acme:devs"},
+		},
+		{
+			name: "org not in filter is rejected",
+			cfg: GiteaAuthConfig{
+				Orgs: []OrgFilter{{Name: "widgets"}},
+			},
+			orgs:    []*gitea.Organization{acme},
+			teams:   []*gitea.Team{acmeDevs},
+			wantErr: true,
+		},
+		{
+			name: "team filter matches only named team",
+			cfg: GiteaAuthConfig{
+				Orgs: []OrgFilter{{Name: "acme", Teams: []string{"devs"}}},
+			},
+			orgs:  []*gitea.Organization{acme},
+			teams: []*gitea.Team{acmeDevs, acmeOps},
+			want:  []string{"acme", "acme:devs"},
+		},
+		{
+			name: "team filter with no matching team is rejected",
+			cfg: GiteaAuthConfig{
+				Orgs: []OrgFilter{{Name: "acme", Teams: []string{"nope"}}},
+			},
+			orgs:    []*gitea.Organization{acme},
+			teams:   []*gitea.Team{acmeDevs},
+			wantErr: true,
+		},
+		{
+			name: "LoadAllGroups bypasses the filter",
+			cfg: GiteaAuthConfig{
+				Orgs:          []OrgFilter{{Name: "widgets"}},
+				LoadAllGroups: true,
+			},
+			orgs:  []*gitea.Organization{acme, widgets},
+			teams: []*gitea.Team{acmeDevs},
+			want:  []string{"acme", "acme:devs", "widgets"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			gta := &GiteaAuth{config: &tc.cfg}
+
+			got, err := gta.buildGroups(tc.orgs, tc.teams)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("buildGroups() error = nil, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("buildGroups() unexpected error: %s", err)
+			}
+
+			sort.Strings(got)
+			sort.Strings(tc.want)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("buildGroups() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMissingScopes(t *testing.T) {
+	tests := []struct {
+		name     string
+		required []string
+		have     []string
+		want     []string
+	}{
+		{name: "no requirements", required: nil, have: []string{"read:org"}, want: nil},
+		{name: "all satisfied", required: []string{"read:org"}, have: []string{"read:org", "read:user"}, want: nil},
+		{name: "some missing", required: []string{"read:org", "write:package"}, have: []string{"read:org"}, want: []string{"write:package"}},
+		{name: "none satisfied", required: []string{"read:org"}, have: nil, want: []string{"read:org"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := missingScopes(tc.required, tc.have)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("missingScopes(%v, %v) = %v, want %v", tc.required, tc.have, got, tc.want)
+			}
+		})
+	}
+}
+
+// stubRoundTripper replays a fixed sequence of responses/errors, one per
+// RoundTrip call, and counts how many times it was invoked.
+type stubRoundTripper struct {
+	calls     int
+	responses []*http.Response
+	errs      []error
+}
+
+func (s *stubRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	i := s.calls
+	s.calls++
+	var err error
+	if i < len(s.errs) {
+		err = s.errs[i]
+	}
+	var resp *http.Response
+	if i < len(s.responses) {
+		resp = s.responses[i]
+	}
+	return resp, err
+}
+
+func statusResponse(code int) *http.Response {
+	return &http.Response{StatusCode: code, Body: io.NopCloser(nil)}
+}
+
+func TestRetryingRoundTripperSucceedsAfterRetry(t *testing.T) {
+	stub := &stubRoundTripper{
+		responses: []*http.Response{statusResponse(http.StatusServiceUnavailable), statusResponse(http.StatusOK)},
+	}
+	rt := &retryingRoundTripper{next: stub, maxAttempts: 3, backoff: time.Millisecond}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.invalid", nil)
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() unexpected error: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("RoundTrip() status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if stub.calls != 2 {
+		t.Errorf("RoundTrip() made %d attempts, want 2", stub.calls)
+	}
+}
+
+func TestRetryingRoundTripperExhaustsAttempts(t *testing.T) {
+	stub := &stubRoundTripper{errs: []error{
+		fmt.Errorf("boom"), fmt.Errorf("boom"), fmt.Errorf("boom"),
+	}}
+	rt := &retryingRoundTripper{next: stub, maxAttempts: 3, backoff: time.Millisecond}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.invalid", nil)
+	_, err := rt.RoundTrip(req)
+	if err == nil {
+		t.Fatal("RoundTrip() error = nil, want an error")
+	}
+	if stub.calls != 3 {
+		t.Errorf("RoundTrip() made %d attempts, want 3", stub.calls)
+	}
+}
+
+// fakeTokenDB is an in-memory TokenDB for tests that don't need persistence.
+type fakeTokenDB struct {
+	values map[string]*TokenDBValue
+}
+
+func (db *fakeTokenDB) GetValue(user string) (*TokenDBValue, error) {
+	return db.values[user], nil
+}
+
+func (db *fakeTokenDB) StoreToken(user string, v *TokenDBValue, updatePassword bool) (*TokenDBValue, error) {
+	if db.values == nil {
+		db.values = map[string]*TokenDBValue{}
+	}
+	db.values[user] = v
+	return v, nil
+}
+
+// tokenEndpoint spins up a stub of Gitea's access_token endpoint that
+// echoes back whichever grant_type it was asked to exchange.
+func tokenEndpoint(t *testing.T) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatalf("could not parse form: %s", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(giteaOAuthToken{
+			AccessToken:  "access-for-" + r.FormValue("grant_type"),
+			TokenType:    "bearer",
+			ExpiresIn:    3600,
+			RefreshToken: "new-refresh-token",
+		})
+	}))
+}
+
+func TestExchangeCode(t *testing.T) {
+	srv := tokenEndpoint(t)
+	defer srv.Close()
+
+	gta := &GiteaAuth{
+		config: &GiteaAuthConfig{ApiUri: srv.URL, ClientID: "id", ClientSecret: "secret", RedirectURI: "http://cb"},
+		client: srv.Client(),
+	}
+
+	tok, err := gta.exchangeCode("some-code")
+	if err != nil {
+		t.Fatalf("exchangeCode() unexpected error: %s", err)
+	}
+	if tok.AccessToken != "access-for-authorization_code" {
+		t.Errorf("exchangeCode() access token = %q, want grant_type=authorization_code to have been sent", tok.AccessToken)
+	}
+}
+
+func TestRefreshTokenRequest(t *testing.T) {
+	srv := tokenEndpoint(t)
+	defer srv.Close()
+
+	gta := &GiteaAuth{
+		config: &GiteaAuthConfig{ApiUri: srv.URL, ClientID: "id", ClientSecret: "secret"},
+		client: srv.Client(),
+	}
+
+	tok, err := gta.refreshToken("old-refresh-token")
+	if err != nil {
+		t.Fatalf("refreshToken() unexpected error: %s", err)
+	}
+	if tok.AccessToken != "access-for-refresh_token" {
+		t.Errorf("refreshToken() access token = %q, want grant_type=refresh_token to have been sent", tok.AccessToken)
+	}
+	if tok.RefreshToken != "new-refresh-token" {
+		t.Errorf("refreshToken() refresh token = %q, want rotated refresh token", tok.RefreshToken)
+	}
+}
+
+func TestGiteaCallbackHandlerRejectsBadState(t *testing.T) {
+	gta := &GiteaAuth{config: &GiteaAuthConfig{Mode: GiteaAuthModeOAuth2}}
+
+	req := httptest.NewRequest(http.MethodGet, "/gitea/callback?state=expected&code=abc", nil)
+	req.AddCookie(&http.Cookie{Name: "gitea_oauth_state", Value: "does-not-match"})
+	w := httptest.NewRecorder()
+
+	gta.GiteaCallbackHandler(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("GiteaCallbackHandler() status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestGiteaCallbackHandlerDisabledOutsideOAuth2Mode(t *testing.T) {
+	gta := &GiteaAuth{config: &GiteaAuthConfig{Mode: GiteaAuthModeBasic}}
+
+	req := httptest.NewRequest(http.MethodGet, "/gitea/callback", nil)
+	w := httptest.NewRecorder()
+
+	gta.GiteaCallbackHandler(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GiteaCallbackHandler() status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestAuthenticateOAuth2CachedToken(t *testing.T) {
+	tests := []struct {
+		name           string
+		requiredScopes []string
+		cachedScopes   []string
+		wantErr        bool
+	}{
+		{name: "no scopes required", wantErr: false},
+		{name: "cached scopes satisfy requirement", requiredScopes: []string{"read:org"}, cachedScopes: []string{"read:org"}, wantErr: false},
+		{name: "cached scopes no longer satisfy requirement", requiredScopes: []string{"read:org"}, cachedScopes: []string{"read:user"}, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dph, err := bcrypt.GenerateFromPassword([]byte("sometoken"), bcrypt.DefaultCost)
+			if err != nil {
+				t.Fatalf("could not hash test password: %s", err)
+			}
+
+			db := &fakeTokenDB{values: map[string]*TokenDBValue{
+				"alice": {
+					AccessToken: string(dph),
+					ValidUntil:  time.Now().Add(time.Hour),
+					Labels:      map[string][]string{"group": {"acme"}},
+					Scopes:      tc.cachedScopes,
+				},
+			}}
+
+			gta := &GiteaAuth{
+				config: &GiteaAuthConfig{Mode: GiteaAuthModeOAuth2, RequiredScopes: tc.requiredScopes},
+				db:     db,
+			}
+
+			ok, _, err := gta.authenticateOAuth2("alice", "sometoken")
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("authenticateOAuth2() error = nil, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("authenticateOAuth2() unexpected error: %s", err)
+			}
+			if !ok {
+				t.Error("authenticateOAuth2() ok = false, want true")
+			}
+		})
+	}
+}
+
+func TestAuthenticateOAuth2ExpiredWithoutRefreshToken(t *testing.T) {
+	dph, err := bcrypt.GenerateFromPassword([]byte("sometoken"), bcrypt.DefaultCost)
+	if err != nil {
+		t.Fatalf("could not hash test password: %s", err)
+	}
+
+	db := &fakeTokenDB{values: map[string]*TokenDBValue{
+		"alice": {AccessToken: string(dph), ValidUntil: time.Now().Add(-time.Hour)},
+	}}
+
+	gta := &GiteaAuth{config: &GiteaAuthConfig{Mode: GiteaAuthModeOAuth2}, db: db}
+
+	_, _, err = gta.authenticateOAuth2("alice", "sometoken")
+	if err != ExpiredToken {
+		t.Errorf("authenticateOAuth2() error = %v, want ExpiredToken", err)
+	}
+}
@@ -0,0 +1,101 @@
+package authn
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+)
+
+// ExpiredToken is returned by the Gitea authenticator when a stored token's
+// ValidUntil has passed; TokenDB.GetValue itself does not check expiry.
+var ExpiredToken = errors.New("expired token")
+
+// TokenDBValue is what we store as a result of token authentication.
+type TokenDBValue struct {
+	TokenType    string     `json:"token_type"`
+	AccessToken  string     `json:"access_token"`
+	RefreshToken string     `json:"refresh_token,omitempty"`
+	ValidUntil   time.Time  `json:"valid_until"`
+	Labels       api.Labels `json:"labels,omitempty"`
+	Scopes       []string   `json:"scopes,omitempty"`
+}
+
+// TokenDB stores the result of a successful credential exchange (basic auth
+// password hash or OAuth2 token) so that it can be revalidated cheaply on
+// subsequent requests without hitting Gitea every time.
+type TokenDB interface {
+	GetValue(user string) (*TokenDBValue, error)
+	StoreToken(user string, v *TokenDBValue, updatePassword bool) (*TokenDBValue, error)
+}
+
+// NewTokenDB opens the token database at path. An empty path disables
+// persistence and keeps everything in memory for the lifetime of the
+// process.
+func NewTokenDB(path string) (TokenDB, error) {
+	db := &fileTokenDB{
+		path:   path,
+		values: map[string]*TokenDBValue{},
+	}
+
+	if path == "" {
+		return db, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return db, nil
+		}
+		return nil, fmt.Errorf("could not open token db %q: %s", path, err)
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(&db.values); err != nil {
+		return nil, fmt.Errorf("could not parse token db %q: %s", path, err)
+	}
+
+	return db, nil
+}
+
+// fileTokenDB is a TokenDB backed by a JSON file, rewritten in full on
+// every StoreToken call.
+type fileTokenDB struct {
+	mu     sync.Mutex
+	path   string
+	values map[string]*TokenDBValue
+}
+
+func (db *fileTokenDB) GetValue(user string) (*TokenDBValue, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.values[user], nil
+}
+
+func (db *fileTokenDB) StoreToken(user string, v *TokenDBValue, updatePassword bool) (*TokenDBValue, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.values[user] = v
+
+	if db.path == "" {
+		return v, nil
+	}
+
+	f, err := os.Create(db.path)
+	if err != nil {
+		return nil, fmt.Errorf("could not write token db %q: %s", db.path, err)
+	}
+	defer f.Close()
+
+	if err := json.NewEncoder(f).Encode(db.values); err != nil {
+		return nil, fmt.Errorf("could not write token db %q: %s", db.path, err)
+	}
+
+	return v, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/cesanta/docker_auth/auth_server/api"
+	"github.com/cesanta/docker_auth/auth_server/authn"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the top-level auth server configuration.
+type Config struct {
+	Server struct {
+		Addr string `yaml:"addr,omitempty"`
+	} `yaml:"server,omitempty"`
+	Gitea *authn.GiteaAuthConfig `yaml:"gitea_auth,omitempty"`
+}
+
+// AuthServer serves the auxiliary routes its authenticators need (e.g.
+// Gitea's OAuth2 login/callback); it registers no docker registry token
+// endpoint of its own.
+type AuthServer struct {
+	mux *http.ServeMux
+}
+
+// NewAuthServer builds the mux, registering the authenticators' routes.
+func NewAuthServer(authenticators []api.Authenticator) *AuthServer {
+	mux := http.NewServeMux()
+	registerAuthnRoutes(mux, authenticators)
+	return &AuthServer{mux: mux}
+}
+
+func (s *AuthServer) ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, s.mux)
+}
+
+// registerAuthnRoutes adds the routes of each *authn.GiteaAuth in
+// authenticators (its OAuth2 login/callback endpoints) to mux; other
+// authenticators are skipped.
+func registerAuthnRoutes(mux *http.ServeMux, authenticators []api.Authenticator) {
+	for _, a := range authenticators {
+		if gta, ok := a.(*authn.GiteaAuth); ok {
+			gta.RegisterRoutes(mux)
+		}
+	}
+}
+
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config %q: %s", path, err)
+	}
+	var c Config
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("could not parse config %q: %s", path, err)
+	}
+	return &c, nil
+}
+
+func main() {
+	configPath := flag.String("config", "config.yml", "path to the auth server config file")
+	flag.Parse()
+
+	c, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var authenticators []api.Authenticator
+	if c.Gitea != nil {
+		gta, err := authn.NewGiteaAuth(c.Gitea)
+		if err != nil {
+			log.Fatalf("could not initialize gitea auth: %s", err)
+		}
+		authenticators = append(authenticators, gta)
+	}
+
+	log.Fatal(NewAuthServer(authenticators).ListenAndServe(c.Server.Addr))
+}